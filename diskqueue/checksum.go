@@ -0,0 +1,127 @@
+package diskqueue
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+
+	"github.com/zhiqiangxu/util/logger"
+	"go.uber.org/zap"
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// errChecksumMismatch is returned by readRecordLocked when a record's
+// stored crc32c doesn't match its payload. With StrictChecksum set,
+// this fails the read; otherwise the reader skips past the record.
+var errChecksumMismatch = errors.New("diskqueue: checksum mismatch")
+
+// recordHeaderSize is the on-disk framing overhead before a record's
+// payload: {len uint32, crc32c uint32, seq uint64, codec uint8},
+// big-endian.
+const recordHeaderSize = 4 + 4 + 8 + 1
+
+const (
+	hdrLenOff   = 0
+	hdrCrcOff   = 4
+	hdrSeqOff   = 8
+	hdrCodecOff = 16
+)
+
+func putRecordHeader(buf []byte, size int, crc uint32, seq uint64, codec uint8) {
+	binary.BigEndian.PutUint32(buf[hdrLenOff:], uint32(size))
+	binary.BigEndian.PutUint32(buf[hdrCrcOff:], crc)
+	binary.BigEndian.PutUint64(buf[hdrSeqOff:], seq)
+	buf[hdrCodecOff] = codec
+}
+
+func parseRecordHeader(buf []byte) (size int, crc uint32, seq uint64, codec uint8) {
+	size = int(binary.BigEndian.Uint32(buf[hdrLenOff:]))
+	crc = binary.BigEndian.Uint32(buf[hdrCrcOff:])
+	seq = binary.BigEndian.Uint64(buf[hdrSeqOff:])
+	codec = buf[hdrCodecOff]
+	return
+}
+
+// recoverTail validates the tail qfile past its last recorded
+// EndOffset, advancing over any fully-written, CRC-valid records that
+// crashed before queueMeta caught up, and truncating at the first
+// invalid or truncated record so a future Read never parses garbage
+// as a message.
+func (p *partition) recoverTail() error {
+	if len(p.files) == 0 {
+		return nil
+	}
+
+	idx := len(p.files) - 1
+	qf := p.files[idx]
+	fm := p.meta.FileMeta(idx)
+
+	region, ok := qf.Mapped()
+	if !ok {
+		return nil
+	}
+
+	pos := fm.EndOffset
+	count := fm.MsgCount
+	var recoveredBytes int64
+	// seq is written monotonically starting at 1 (stageRecord does
+	// p.seq++ before putRecordHeader), so a header reporting seq 0 can
+	// only be unwritten, zero-filled qfile padding, not a real record
+	// - crucially even when size and crc both happen to be 0 too,
+	// which is the all-zero tail every preallocated file has past its
+	// last write. Require seq to keep increasing past the last
+	// recovered record to reject that padding instead of "recovering"
+	// it as a run of empty messages.
+	var prevSeq uint64
+
+	for {
+		if pos+recordHeaderSize > int64(len(region)) {
+			break
+		}
+		size, crc, seq, _ := parseRecordHeader(region[pos : pos+recordHeaderSize])
+		// No upper bound against MaxMsgSize here: size is the
+		// codec-encoded length, which can legitimately run past the
+		// raw-payload limit (AES-GCM's nonce+tag, snappy/zstd framing
+		// overhead, ...). The end-of-region and CRC checks below are
+		// what actually guard against treating garbage as a record.
+		if size < 0 {
+			break
+		}
+		if seq <= prevSeq {
+			break
+		}
+		start := pos + recordHeaderSize
+		end := start + int64(size)
+		if end > int64(len(region)) {
+			break
+		}
+		if crc32.Checksum(region[start:end], castagnoli) != crc {
+			break
+		}
+
+		pos = end
+		count++
+		prevSeq = seq
+		recoveredBytes += recordHeaderSize + int64(size)
+	}
+
+	discardedBytes := int64(len(region)) - pos
+	if recoveredBytes == 0 && discardedBytes == 0 {
+		return nil
+	}
+
+	logger.Instance().Info(
+		"recoverTail",
+		zap.Int("partition", p.idx),
+		zap.Int("file", idx),
+		zap.Int64("recoveredBytes", recoveredBytes),
+		zap.Int64("discardedBytes", discardedBytes),
+	)
+
+	if err := qf.Truncate(pos); err != nil {
+		return err
+	}
+	p.meta.UpdateFileStat(idx, count, pos, NowNano())
+	return nil
+}
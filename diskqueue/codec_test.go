@@ -0,0 +1,86 @@
+package diskqueue
+
+import "testing"
+
+func TestBuiltinCodecRoundTrip(t *testing.T) {
+	key := []byte("0123456789abcdef0123456789abcdef")[:32]
+	aesGCM, err := newAESGCMCodec(key)
+	if err != nil {
+		t.Fatalf("newAESGCMCodec: %v", err)
+	}
+
+	codecs := []Codec{noopCodec{}, snappyCodec{}, newZstdCodec(), aesGCM}
+	payload := []byte("the quick brown fox jumps over the lazy dog")
+
+	for _, codec := range codecs {
+		encoded, err := codec.Encode(nil, payload)
+		if err != nil {
+			t.Fatalf("codec %d Encode: %v", codec.ID(), err)
+		}
+		decoded, err := codec.Decode(nil, encoded)
+		if err != nil {
+			t.Fatalf("codec %d Decode: %v", codec.ID(), err)
+		}
+		if string(decoded) != string(payload) {
+			t.Fatalf("codec %d round trip = %q, want %q", codec.ID(), decoded, payload)
+		}
+	}
+}
+
+// fakeReservedIDCodec pretends to be a custom codec but reuses the
+// built-in snappy codec's reserved ID.
+type fakeReservedIDCodec struct{ snappyCodec }
+
+func (fakeReservedIDCodec) ID() uint8 { return codecSnappy }
+
+func TestCodecSetActiveRejectsReservedID(t *testing.T) {
+	conf := &Conf{Codec: fakeReservedIDCodec{}}
+	cs, err := newCodecSet(conf)
+	if err != nil {
+		t.Fatalf("newCodecSet: %v", err)
+	}
+
+	if _, err := cs.active(conf); err != errReservedCodecID {
+		t.Fatalf("active() err = %v, want errReservedCodecID", err)
+	}
+
+	// The built-in occupying that slot must still be the one used to
+	// decode it - a silent overwrite would corrupt already-written data.
+	got, err := cs.get(codecSnappy)
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	if _, ok := got.(snappyCodec); !ok {
+		t.Fatalf("codecSnappy slot was overwritten by the custom codec")
+	}
+}
+
+func TestCodecSetActiveRegistersCustomID(t *testing.T) {
+	conf := &Conf{Codec: noopCustomCodec{id: 42}}
+	cs, err := newCodecSet(conf)
+	if err != nil {
+		t.Fatalf("newCodecSet: %v", err)
+	}
+
+	active, err := cs.active(conf)
+	if err != nil {
+		t.Fatalf("active: %v", err)
+	}
+	if active.ID() != 42 {
+		t.Fatalf("active codec id = %d, want 42", active.ID())
+	}
+
+	got, err := cs.get(42)
+	if err != nil {
+		t.Fatalf("get(42): %v", err)
+	}
+	if got.ID() != 42 {
+		t.Fatalf("registered codec id = %d, want 42", got.ID())
+	}
+}
+
+type noopCustomCodec struct{ id uint8 }
+
+func (c noopCustomCodec) Encode(dst, src []byte) ([]byte, error) { return append(dst, src...), nil }
+func (c noopCustomCodec) Decode(dst, src []byte) ([]byte, error) { return append(dst, src...), nil }
+func (c noopCustomCodec) ID() uint8                              { return c.id }
@@ -0,0 +1,348 @@
+package diskqueue
+
+import (
+	"sync"
+	"time"
+
+	"github.com/zhiqiangxu/util"
+	"github.com/zhiqiangxu/util/logger"
+	"go.uber.org/zap"
+)
+
+// Consumer is an independent, named cursor over a Queue's on-disk log.
+// Multiple Consumers may read the same Queue at their own pace, each
+// with its own committed (fileIndex, pos) per partition, persisted
+// under the group's section of queueMeta.
+type Consumer struct {
+	q     *Queue
+	group string
+
+	lanes  []*consumerLane
+	readCh chan Message
+	errCh  chan error
+
+	lanesWG   sync.WaitGroup
+	closeOnce sync.Once
+	closeCh   chan struct{}
+}
+
+type consumerLane struct {
+	p *partition
+
+	mu sync.Mutex
+
+	fileIndex    int
+	pos          int64
+	ackFileIndex int
+	ackPos       int64
+	dirty        bool
+}
+
+const defaultConsumerChSize = 128
+
+// Subscribe registers (or resumes) a named consumer group and starts
+// one goroutine per partition tailing the log for it. groupName must
+// be stable across restarts for the cursor to resume correctly.
+func (q *Queue) Subscribe(groupName string) (c *Consumer, err error) {
+	return q.SubscribeFrom(groupName, 0)
+}
+
+// SubscribeFrom is like Subscribe, but positions the group at
+// startOffset in the one partition startOffset names, provided the
+// group's persisted cursor there is still at the start of the log (a
+// group seen for the first time, or one that has never acked in that
+// partition). Every other partition, and a partition whose persisted
+// cursor has moved past the start, resumes from queueMeta exactly as
+// Subscribe does. Remote consumers use this to resume a dropped connection from their
+// last acked offset without replaying the whole log on first connect.
+func (q *Queue) SubscribeFrom(groupName string, startOffset int64) (c *Consumer, err error) {
+	err = q.checkCloseState()
+	if err != nil {
+		return
+	}
+
+	startPartIdx, startFileIndex, startPos := decodeOffset(startOffset)
+
+	c = &Consumer{
+		q:       q,
+		group:   groupName,
+		lanes:   make([]*consumerLane, len(q.partitions)),
+		readCh:  make(chan Message, defaultConsumerChSize),
+		errCh:   make(chan error, len(q.partitions)),
+		closeCh: make(chan struct{}),
+	}
+
+	for i, p := range q.partitions {
+		var fileIndex int
+		var pos int64
+		fileIndex, pos, err = p.meta.GroupCursor(groupName, p.idx)
+		if err != nil {
+			return
+		}
+		if fileIndex == 0 && pos == 0 && startOffset != 0 && i == startPartIdx {
+			fileIndex, pos = startFileIndex, startPos
+		}
+		c.lanes[i] = &consumerLane{p: p, fileIndex: fileIndex, pos: pos, ackFileIndex: fileIndex, ackPos: pos}
+	}
+
+	q.groupsMu.Lock()
+	if old, ok := q.groups[groupName]; ok {
+		old.Close()
+	}
+	q.groups[groupName] = c
+	q.groupsMu.Unlock()
+
+	for _, lane := range c.lanes {
+		lane := lane
+		c.lanesWG.Add(1)
+		util.GoFunc(&q.wg, func() {
+			defer c.lanesWG.Done()
+			c.run(lane)
+		})
+	}
+	return
+}
+
+// ReadChan returns the consumer's stream of messages, merged across
+// partitions.
+func (c *Consumer) ReadChan() <-chan Message {
+	return c.readCh
+}
+
+// ErrChan surfaces unrecoverable per-partition read errors for this
+// group: with StrictChecksum set, a corrupt record halts that
+// partition's lane goroutine (instead of retrying it forever) and its
+// error is reported here so callers notice the group stalled rather
+// than just seeing ReadChan go quiet.
+func (c *Consumer) ErrChan() <-chan error {
+	return c.errCh
+}
+
+// Ack commits the consumer's cursor for offset's partition up to
+// offset. The commit is persisted by the owning Queue's handleCommit
+// goroutine.
+func (c *Consumer) Ack(offset int64) error {
+	partIdx, fileIndex, pos := decodeOffset(offset)
+	if partIdx < 0 || partIdx >= len(c.lanes) {
+		return errBadOffset
+	}
+
+	lane := c.lanes[partIdx]
+	lane.mu.Lock()
+	if fileIndex > lane.ackFileIndex || (fileIndex == lane.ackFileIndex && pos > lane.ackPos) {
+		lane.ackFileIndex = fileIndex
+		lane.ackPos = pos
+		lane.dirty = true
+	}
+	lane.mu.Unlock()
+
+	select {
+	case c.q.ackNotifyCh <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// cursor returns the lowest (fileIndex) this consumer has acked up to
+// for a given partition, used by the reaper to compute the minimum
+// retained position across groups.
+func (c *Consumer) cursor(partIdx int) (fileIndex int, pos int64) {
+	lane := c.lanes[partIdx]
+	lane.mu.Lock()
+	fileIndex, pos = lane.ackFileIndex, lane.ackPos
+	lane.mu.Unlock()
+	return
+}
+
+func (c *Consumer) run(lane *consumerLane) {
+	q := c.q
+	for {
+		lane.mu.Lock()
+		data, size, err := lane.p.readRecordLocked(lane.fileIndex, lane.pos)
+		var offset int64
+		if err == nil {
+			offset = encodeOffset(lane.p.idx, lane.fileIndex, lane.pos)
+			lane.pos += int64(size)
+			fm := lane.p.meta.FileMeta(lane.fileIndex)
+			if lane.pos >= fm.EndOffset && lane.fileIndex < len(lane.p.files)-1 {
+				lane.fileIndex++
+				lane.pos = 0
+			}
+		}
+		lane.mu.Unlock()
+
+		if err != nil {
+			if err == errChecksumMismatch {
+				logger.Instance().Error("Consumer.run halted on checksum mismatch", zap.String("group", c.group), zap.Int("partition", lane.p.idx), zap.Error(err))
+				select {
+				case c.errCh <- err:
+				default:
+				}
+				return
+			}
+			select {
+			case <-time.After(100 * time.Millisecond):
+			case <-q.doneCh:
+				return
+			case <-c.closeCh:
+				return
+			}
+			continue
+		}
+
+		select {
+		case c.readCh <- Message{Offset: offset, Data: data}:
+		case <-q.doneCh:
+			return
+		case <-c.closeCh:
+			return
+		}
+	}
+}
+
+// Close stops this consumer's lane goroutines without persisting any
+// further cursor updates, then closes readCh once every lane has
+// exited so anything still blocked reading it (e.g. a server's
+// per-connection handler, which treats a closed channel as "this
+// consumer is gone") unblocks promptly instead of leaking. Resubscribing
+// the same group name (e.g. a remote client reconnecting) closes the
+// superseded Consumer first so its lanes don't keep running unread.
+func (c *Consumer) Close() {
+	c.closeOnce.Do(func() {
+		close(c.closeCh)
+		go func() {
+			c.lanesWG.Wait()
+			close(c.readCh)
+		}()
+	})
+}
+
+func (c *Consumer) sync() {
+	for _, lane := range c.lanes {
+		lane.mu.Lock()
+		if !lane.dirty {
+			lane.mu.Unlock()
+			continue
+		}
+		fileIndex, pos := lane.ackFileIndex, lane.ackPos
+		lane.dirty = false
+		lane.mu.Unlock()
+
+		if err := lane.p.meta.UpdateGroupCursor(c.group, lane.p.idx, fileIndex, pos); err != nil {
+			logger.Instance().Error("Consumer.sync UpdateGroupCursor", zap.String("group", c.group), zap.Int("partition", lane.p.idx), zap.Error(err))
+		}
+	}
+}
+
+// syncGroupCursors persists every subscribed group's committed
+// cursors; called from handleCommit alongside the default readers.
+func (q *Queue) syncGroupCursors() {
+	q.groupsMu.RLock()
+	consumers := make([]*Consumer, 0, len(q.groups))
+	for _, c := range q.groups {
+		consumers = append(consumers, c)
+	}
+	q.groupsMu.RUnlock()
+
+	for _, c := range consumers {
+		c.sync()
+	}
+}
+
+// minRetainedFileIndex returns, per partition, the lowest file index
+// any consumer group (plus the default streaming reader, if an
+// application actually acks against it) still has unacked data in,
+// i.e. the first qfile that must NOT be reclaimed yet.
+func (q *Queue) minRetainedFileIndex(partIdx int) int {
+	lanes := q.readers()
+	lanes[partIdx].reader.mu.Lock()
+	used, ackFileIndex := lanes[partIdx].reader.used, lanes[partIdx].reader.ackFileIndex
+	lanes[partIdx].reader.mu.Unlock()
+
+	minIndex := -1
+	if used {
+		minIndex = ackFileIndex
+	}
+
+	q.groupsMu.RLock()
+	for _, c := range q.groups {
+		fileIndex, _ := c.cursor(partIdx)
+		if minIndex == -1 || fileIndex < minIndex {
+			minIndex = fileIndex
+		}
+	}
+	q.groupsMu.RUnlock()
+
+	if minIndex == -1 {
+		// Nothing is actually consuming this partition: don't retain
+		// anything beyond what RetentionBytes/RetentionAge already keep.
+		minIndex = q.partitions[partIdx].meta.NumFiles()
+	}
+
+	return minIndex
+}
+
+// handleReap periodically reclaims qfiles that every consumer group
+// has moved past, honoring RetentionBytes/RetentionAge as a floor on
+// top of the cursor-based bound.
+func (q *Queue) handleReap() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			for _, p := range q.partitions {
+				q.reapPass(p)
+			}
+		case <-q.doneCh:
+			return
+		}
+	}
+}
+
+func (q *Queue) reapPass(p *partition) {
+	minIndex := q.minRetainedFileIndex(p.idx)
+
+	p.filesMu.RLock()
+	nFiles := len(p.files)
+	p.filesMu.RUnlock()
+	if minIndex > nFiles-1 {
+		minIndex = nFiles - 1
+	}
+
+	var retainedBytes int64
+	now := NowNano()
+
+	// walk backwards from the reclaim boundary so RetentionBytes/Age
+	// can force additional files to be kept even though every group
+	// has acked past them.
+	keepFrom := minIndex
+	for i := minIndex - 1; i >= 0; i-- {
+		fm := p.meta.FileMeta(i)
+		retainedBytes += fm.EndOffset
+		ageOK := q.conf.RetentionAge <= 0 || time.Duration(now-fm.UpdatedAt) <= q.conf.RetentionAge
+		bytesOK := q.conf.RetentionBytes <= 0 || retainedBytes <= q.conf.RetentionBytes
+		if ageOK && bytesOK {
+			keepFrom = i
+			continue
+		}
+		break
+	}
+
+	p.filesMu.Lock()
+	defer p.filesMu.Unlock()
+	for i := 0; i < keepFrom && i < len(p.files)-1; i++ {
+		qf := p.files[i]
+		if qf.Reclaimed() {
+			continue
+		}
+		if err := qf.Shrink(); err != nil {
+			logger.Instance().Error("reapPass Shrink", zap.Int("partition", p.idx), zap.Int("file", i), zap.Error(err))
+			continue
+		}
+		if err := qf.Reclaim(); err != nil {
+			logger.Instance().Error("reapPass Reclaim", zap.Int("partition", p.idx), zap.Int("file", i), zap.Error(err))
+		}
+	}
+}
@@ -1,12 +1,8 @@
 package diskqueue
 
 import (
-	"encoding/binary"
 	"errors"
 	"fmt"
-	"net"
-	"os"
-	"path/filepath"
 	"sync"
 	"time"
 
@@ -14,7 +10,6 @@ import (
 
 	"github.com/zhiqiangxu/util"
 	"github.com/zhiqiangxu/util/logger"
-	"github.com/zhiqiangxu/util/mapped"
 	"go.uber.org/zap"
 )
 
@@ -32,19 +27,32 @@ var _ queueInterface = (*Queue)(nil)
 type Queue struct {
 	closeState uint32
 	wg         sync.WaitGroup
-	meta       *queueMeta
 	conf       Conf
-	writeCh    chan *writeRequest
-	writeReqs  []*writeRequest
-	writeBuffs net.Buffers
-	sizeBuffs  []byte
 	doneCh     chan struct{}
-	files      []*qfile
+
+	partitions []*partition
+	writeSem   writeSemaphore
+	rrCursor   uint32
+
+	lanesOnce   sync.Once
+	lanes       []*readerLane
+	readCh      chan Message
+	errCh       chan error
+	ackNotifyCh chan struct{}
+
+	closeMu    sync.Mutex
+	closeHooks []func()
+
+	groupsMu sync.RWMutex
+	groups   map[string]*Consumer
 }
 
 const (
-	defaultWriteBatch = 1
-	defaultMaxMsgSize = 512 * 1024 * 1024
+	defaultWriteBatch  = 1
+	defaultMaxMsgSize  = 512 * 1024 * 1024
+	defaultSyncEvery   = 1000
+	defaultSyncTimeout = 2 * time.Second
+	defaultReadChSize  = 128
 )
 
 // New is ctor for Queue
@@ -55,9 +63,30 @@ func New(conf Conf) *Queue {
 	if conf.MaxMsgSize <= 0 {
 		conf.MaxMsgSize = defaultMaxMsgSize
 	}
+	if conf.SyncEvery <= 0 {
+		conf.SyncEvery = defaultSyncEvery
+	}
+	if conf.SyncTimeout <= 0 {
+		conf.SyncTimeout = defaultSyncTimeout
+	}
+	if conf.Partitions <= 0 {
+		conf.Partitions = defaultPartitions
+	}
 
-	q := &Queue{conf: conf, writeCh: make(chan *writeRequest, conf.WriteBatch), writeReqs: make([]*writeRequest, 0, conf.WriteBatch), writeBuffs: make(net.Buffers, 0, conf.WriteBatch*2), sizeBuffs: make([]byte, 4*conf.WriteBatch), doneCh: make(chan struct{})}
-	q.meta = newQueueMeta(&q.conf)
+	q := &Queue{
+		conf:        conf,
+		doneCh:      make(chan struct{}),
+		readCh:      make(chan Message, defaultReadChSize),
+		errCh:       make(chan error, conf.Partitions),
+		ackNotifyCh: make(chan struct{}, 1),
+		groups:      make(map[string]*Consumer),
+		writeSem:    newWriteSemaphore(conf.MaxConcurrentWrites),
+	}
+
+	q.partitions = make([]*partition, conf.Partitions)
+	for i := range q.partitions {
+		q.partitions[i] = newPartition(&q.conf, i)
+	}
 	return q
 }
 
@@ -67,69 +96,25 @@ const (
 
 // Init the queue
 func (q *Queue) Init() (err error) {
-
-	// 确保各种目录存在
-	err = os.MkdirAll(filepath.Join(q.conf.Directory, qfSubDir), dirPerm)
-	if err != nil {
-		return
-	}
-
-	// 初始化元数据
-	err = q.meta.Init()
-	if err != nil {
-		return
-	}
-
-	// 加载qfile
-	nFiles := q.meta.NumFiles()
-	q.files = make([]*qfile, 0, nFiles)
-	var qf *qfile
-	for i := 0; i < nFiles; i++ {
-		qf, err = openQfile(q.meta, i)
+	for _, p := range q.partitions {
+		err = p.init()
 		if err != nil {
+			logger.Instance().Error("Init partition", zap.Int("partition", p.idx), zap.Error(err))
 			return
 		}
-		if i < (nFiles - 1) {
-			err = qf.Shrink()
-			if err != nil {
-				return
-			}
-		}
-		q.files = append(q.files, qf)
 	}
 
-	// enough data, ready to go!
-	if len(q.files) == 0 {
-		err = q.createQfile()
-		if err != nil {
-			logger.Instance().Error("Init createQfile", zap.Error(err))
-			return
-		}
+	for _, p := range q.partitions {
+		p := p
+		util.GoFunc(&q.wg, func() { q.handleWrite(p) })
 	}
-
-	util.GoFunc(&q.wg, q.handleWrite)
 	util.GoFunc(&q.wg, q.handleCommit)
+	util.GoFunc(&q.wg, q.handleRead)
+	util.GoFunc(&q.wg, q.handleReap)
 
 	return nil
 }
 
-func (q *Queue) createQfile() (err error) {
-	var qf *qfile
-	if len(q.files) == 0 {
-		qf, err = createQfile(q.meta, 0, 0)
-		if err != nil {
-			return
-		}
-	} else {
-		qf, err = createQfile(q.meta, len(q.files), q.files[len(q.files)-1].WrotePosition())
-		if err != nil {
-			return
-		}
-	}
-	q.files = append(q.files, qf)
-	return
-}
-
 type writeResult struct {
 	err    error
 	offset int64
@@ -143,109 +128,15 @@ var wreqPool = sync.Pool{New: func() interface{} {
 	return &writeRequest{result: make(chan writeResult, 1)}
 }}
 
-// dedicated G so that write is serial
-func (q *Queue) handleWrite() {
-	var (
-		wreq           *writeRequest
-		qf             *qfile
-		err            error
-		wroteN, totalN int64
-	)
-
-	startFM := q.meta.FileMeta(len(q.files) - 1)
-	startWrotePosition := startFM.EndOffset
-
-	for {
-		select {
-		case <-q.doneCh:
-			return
-		case wreq = <-q.writeCh:
-			q.writeReqs = q.writeReqs[:0]
-			q.writeBuffs = q.writeBuffs[:0]
-			q.writeReqs = append(q.writeReqs, wreq)
-			q.updateSizeBuf(0, len(wreq.data))
-			q.writeBuffs = append(q.writeBuffs, q.getSizeBuf(0))
-			q.writeBuffs = append(q.writeBuffs, wreq.data)
-
-			// collect more data
-		BatchLoop:
-			for i := 0; i < q.conf.WriteBatch-1; i++ {
-				select {
-				case wreq = <-q.writeCh:
-					q.writeReqs = append(q.writeReqs, wreq)
-					q.updateSizeBuf(i+1, len(wreq.data))
-					q.writeBuffs = append(q.writeBuffs, q.getSizeBuf(i+1))
-					q.writeBuffs = append(q.writeBuffs, wreq.data)
-				default:
-					break BatchLoop
-				}
-			}
-
-			// enough data, ready to go!
-			qf = q.files[len(q.files)-1]
-
-			writeBuffs := q.writeBuffs
-
-			util.TryUntilSuccess(func() bool {
-				wroteN, err = q.writeBuffs.WriteTo(qf)
-				totalN += wroteN
-				if err == mapped.ErrWriteBeyond {
-					// 写超了，需要新开文件
-					err = q.createQfile()
-					if err != nil {
-						logger.Instance().Error("handleWrite createQfile", zap.Error(err))
-					} else {
-						qf = q.files[len(q.files)-1]
-						wroteN, err = q.writeBuffs.WriteTo(qf)
-						totalN += wroteN
-					}
-				}
-				if err != nil {
-					logger.Instance().Error("handleWrite WriteTo", zap.Error(err))
-					return false
-				}
-				return true
-			}, time.Second)
-
-			q.meta.UpdateFileStat(len(q.files)-1, len(q.writeReqs), startWrotePosition+totalN, NowNano())
-			totalN = 0
-			q.writeBuffs = writeBuffs
-
-			// 全部写入成功
-			for _, req := range q.writeReqs {
-				req.result <- writeResult{}
-			}
-
-		}
-	}
-}
-
-func (q *Queue) getSizeBuf(i int) []byte {
-	return q.sizeBuffs[4*i : 4*i+4]
-}
-
-func (q *Queue) updateSizeBuf(i int, size int) {
-	binary.BigEndian.PutUint32(q.sizeBuffs[4*i:], uint32(size))
-}
-
-func (q *Queue) handleCommit() {
-	if !q.conf.EnableWriteBuffer {
-		return
-	}
-
-	ticker := time.NewTicker(time.Second)
-
-	for {
-		select {
-		case <-ticker.C:
-		case <-q.doneCh:
-			return
-		}
-	}
+// Put data to queue, sharding across partitions round-robin. Use
+// PutWithKey to route by a partition key (fnv hashed) instead.
+func (q *Queue) Put(data []byte) (offset int64, err error) {
+	return q.PutWithKey(data, nil)
 }
 
-// Put data to queue
-func (q *Queue) Put(data []byte) (offset int64, err error) {
+// PutWithKey is like Put but pins data to the partition that key
+// hashes to, so records sharing a key are read back in order.
+func (q *Queue) PutWithKey(data, partitionKey []byte) (offset int64, err error) {
 
 	err = q.checkCloseState()
 	if err != nil {
@@ -257,6 +148,8 @@ func (q *Queue) Put(data []byte) (offset int64, err error) {
 		return
 	}
 
+	p := q.choosePartition(partitionKey)
+
 	wreq := wreqPool.Get().(*writeRequest)
 	wreq.data = data
 	if len(wreq.result) > 0 {
@@ -264,7 +157,7 @@ func (q *Queue) Put(data []byte) (offset int64, err error) {
 	}
 
 	select {
-	case q.writeCh <- wreq:
+	case p.writeCh <- wreq:
 		result := <-wreq.result
 		offset = result.offset
 		err = result.err
@@ -276,20 +169,57 @@ func (q *Queue) Put(data []byte) (offset int64, err error) {
 
 }
 
-// ReadFrom for read from offset
+func (q *Queue) choosePartition(partitionKey []byte) *partition {
+	n := len(q.partitions)
+	if n == 1 {
+		return q.partitions[0]
+	}
+	if len(partitionKey) > 0 {
+		return q.partitions[fnvPartition(partitionKey, n)]
+	}
+	idx := atomic.AddUint32(&q.rrCursor, 1)
+	return q.partitions[int(idx)%n]
+}
+
+// Read fills stores with up to len(stores) messages starting at offset
+// (an opaque cursor previously handed out via ReadChan/Ack), without
+// touching the streaming reader's own position.
 func (q *Queue) Read(offset int64, stores [][]byte) (results [][]byte, err error) {
 	err = q.checkCloseState()
 	if err != nil {
 		return
 	}
 
+	partIdx, fileIndex, pos := decodeOffset(offset)
+	if partIdx < 0 || partIdx >= len(q.partitions) {
+		err = errBadOffset
+		return
+	}
+	p := q.partitions[partIdx]
+
+	results = stores[:0]
+	for range stores {
+		var data []byte
+		var size int
+		data, size, err = p.readRecordLocked(fileIndex, pos)
+		if err != nil {
+			if err == errNoData {
+				err = nil
+			}
+			return
+		}
+		results = append(results, data)
+		pos += int64(size)
+	}
 	return
 }
 
 var (
-	errAlreadyClosed  = errors.New("already closed")
-	errAlreadyClosing = errors.New("already closing")
-	errMsgTooLarge    = errors.New("msg too large")
+	errAlreadyClosed      = errors.New("already closed")
+	errAlreadyClosing     = errors.New("already closing")
+	errMsgTooLarge        = errors.New("msg too large")
+	errEncodedMsgTooLarge = errors.New("diskqueue: encoded record too large")
+	errBadOffset          = errors.New("offset addresses an unknown partition")
 )
 
 const (
@@ -312,6 +242,16 @@ func (q *Queue) checkCloseState() (err error) {
 	return
 }
 
+// OnClose registers fn to run synchronously during Close, after new
+// writes/reads stop being accepted but before the queue's own
+// goroutines are torn down. Servers wrapping a Queue over the network
+// use this to drain their in-flight streams first.
+func (q *Queue) OnClose(fn func()) {
+	q.closeMu.Lock()
+	q.closeHooks = append(q.closeHooks, fn)
+	q.closeMu.Unlock()
+}
+
 // Close the queue
 func (q *Queue) Close() (err error) {
 
@@ -320,12 +260,21 @@ func (q *Queue) Close() (err error) {
 		return q.checkCloseState()
 	}
 
+	q.closeMu.Lock()
+	hooks := q.closeHooks
+	q.closeMu.Unlock()
+	for _, hook := range hooks {
+		hook()
+	}
+
 	util.TryUntilSuccess(func() bool {
 		// try until success
-		err = q.meta.Close()
-		if err != nil {
-			logger.Instance().Error("meta.Close", zap.Error(err))
-			return false
+		for _, p := range q.partitions {
+			err = p.meta.Close()
+			if err != nil {
+				logger.Instance().Error("meta.Close", zap.Int("partition", p.idx), zap.Error(err))
+				return false
+			}
 		}
 
 		return true
@@ -343,4 +292,4 @@ func (q *Queue) Close() (err error) {
 // Delete the queue
 func (q *Queue) Delete() error {
 	return nil
-}
\ No newline at end of file
+}
@@ -0,0 +1,334 @@
+package diskqueue
+
+import (
+	"fmt"
+	"hash/crc32"
+	"hash/fnv"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/zhiqiangxu/util"
+	"github.com/zhiqiangxu/util/logger"
+	"github.com/zhiqiangxu/util/mapped"
+	"go.uber.org/zap"
+)
+
+const defaultPartitions = 1
+
+// partition is one independent write pipeline: its own qfile sequence
+// under qfSubDir/partN/, its own queueMeta, and its own handleWrite
+// goroutine. Put shards across partitions so a slow fsync on one
+// doesn't stall the others.
+type partition struct {
+	idx  int
+	conf Conf
+	meta *queueMeta
+
+	filesMu sync.RWMutex
+	files   []*qfile
+
+	writeCh      chan *writeRequest
+	writeReqs    []*writeRequest
+	writeBuffs   net.Buffers
+	sizeBuffs    []byte
+	scratchBuffs [][]byte
+	reqEnds      []int64
+	seq          uint64
+
+	codecs *codecSet
+	codec  Codec
+}
+
+func partitionSubDir(idx int) string {
+	return filepath.Join(qfSubDir, fmt.Sprintf("part%d", idx))
+}
+
+func newPartition(conf *Conf, idx int) *partition {
+	partConf := *conf
+	partConf.Directory = filepath.Join(conf.Directory, partitionSubDir(idx))
+
+	return &partition{
+		idx:          idx,
+		conf:         partConf,
+		meta:         newQueueMeta(&partConf),
+		writeCh:      make(chan *writeRequest, conf.WriteBatch),
+		writeReqs:    make([]*writeRequest, 0, conf.WriteBatch),
+		writeBuffs:   make(net.Buffers, 0, conf.WriteBatch*2),
+		sizeBuffs:    make([]byte, recordHeaderSize*conf.WriteBatch),
+		scratchBuffs: make([][]byte, conf.WriteBatch),
+		reqEnds:      make([]int64, conf.WriteBatch),
+	}
+}
+
+func (p *partition) init() (err error) {
+	err = os.MkdirAll(filepath.Join(p.meta.conf.Directory, qfSubDir), dirPerm)
+	if err != nil {
+		return
+	}
+
+	err = p.meta.Init()
+	if err != nil {
+		return
+	}
+
+	p.codecs, err = newCodecSet(&p.conf)
+	if err != nil {
+		return
+	}
+	p.codec, err = p.codecs.active(&p.conf)
+	if err != nil {
+		return
+	}
+
+	nFiles := p.meta.NumFiles()
+	p.files = make([]*qfile, 0, nFiles)
+	var qf *qfile
+	for i := 0; i < nFiles; i++ {
+		qf, err = openQfile(p.meta, i)
+		if err != nil {
+			return
+		}
+		p.files = append(p.files, qf)
+	}
+
+	if len(p.files) == 0 {
+		err = p.createQfile()
+		return
+	}
+
+	err = p.recoverTail()
+	return
+}
+
+func (p *partition) createQfile() (err error) {
+	var qf *qfile
+	if len(p.files) == 0 {
+		qf, err = createQfile(p.meta, 0, 0)
+	} else {
+		qf, err = createQfile(p.meta, len(p.files), p.files[len(p.files)-1].WrotePosition())
+	}
+	if err != nil {
+		return
+	}
+	p.filesMu.Lock()
+	p.files = append(p.files, qf)
+	p.filesMu.Unlock()
+	return
+}
+
+func (p *partition) getSizeBuf(i int) []byte {
+	return p.sizeBuffs[recordHeaderSize*i : recordHeaderSize*i+recordHeaderSize]
+}
+
+// maxEncodedMsgSize bounds how large a record's codec-encoded form may
+// be for a given Conf.MaxMsgSize. Conf.MaxMsgSize only caps the raw
+// payload Put accepts; the active Codec's output can legitimately run
+// past it (AES-GCM's nonce+tag, snappy/zstd framing, ...), so staging
+// allows generous headroom above MaxMsgSize rather than rejecting that.
+// It still rejects a codec blowing a record up far beyond what
+// MaxMsgSize was sized for, so a misbehaving/misconfigured codec can't
+// hand flushBatch a record too big to ever land in a fresh qfile.
+func maxEncodedMsgSize(maxMsgSize int) int {
+	return maxMsgSize + maxMsgSize/4 + 4096
+}
+
+// stageRecord runs data through the partition's active codec into its
+// batch-slot scratch buffer (reused across batches, never the
+// caller's own memory) and frames the result: length, crc32c of the
+// encoded bytes, a monotonic sequence number, and the codec ID so a
+// later Read can dispatch the matching Decode.
+func (p *partition) stageRecord(i int, data []byte) (encoded []byte, err error) {
+	encoded, err = p.codec.Encode(p.scratchBuffs[i][:0], data)
+	if err != nil {
+		return
+	}
+	if len(encoded) > maxEncodedMsgSize(p.conf.MaxMsgSize) {
+		err = errEncodedMsgTooLarge
+		return
+	}
+	p.scratchBuffs[i] = encoded
+
+	p.seq++
+	putRecordHeader(p.getSizeBuf(i), len(encoded), crc32.Checksum(encoded, castagnoli), p.seq, p.codec.ID())
+	return
+}
+
+// handleWrite is the dedicated G draining this partition's writeCh, so
+// writes within a partition remain serial while partitions progress
+// independently of one another.
+func (q *Queue) handleWrite(p *partition) {
+	var wreq *writeRequest
+
+	startFM := p.meta.FileMeta(len(p.files) - 1)
+	fileIndex := len(p.files) - 1
+	filePos := startFM.EndOffset
+
+	for {
+		select {
+		case <-q.doneCh:
+			return
+		case wreq = <-p.writeCh:
+			p.writeReqs = p.writeReqs[:0]
+			p.writeBuffs = p.writeBuffs[:0]
+			if encoded, encErr := p.stageRecord(0, wreq.data); encErr == nil {
+				p.writeReqs = append(p.writeReqs, wreq)
+				p.writeBuffs = append(p.writeBuffs, p.getSizeBuf(0))
+				p.writeBuffs = append(p.writeBuffs, encoded)
+			} else {
+				wreq.result <- writeResult{err: encErr}
+			}
+
+			// collect more data
+		BatchLoop:
+			for len(p.writeReqs) < q.conf.WriteBatch {
+				select {
+				case wreq = <-p.writeCh:
+					i := len(p.writeReqs)
+					if encoded, encErr := p.stageRecord(i, wreq.data); encErr == nil {
+						p.writeReqs = append(p.writeReqs, wreq)
+						p.writeBuffs = append(p.writeBuffs, p.getSizeBuf(i))
+						p.writeBuffs = append(p.writeBuffs, encoded)
+					} else {
+						wreq.result <- writeResult{err: encErr}
+					}
+				default:
+					break BatchLoop
+				}
+			}
+
+			if len(p.writeReqs) == 0 {
+				continue
+			}
+
+			q.writeSem.acquire()
+			fileIndex, filePos = p.flushBatch(fileIndex, filePos)
+			q.writeSem.release()
+		}
+	}
+}
+
+// flushBatch writes every request staged in p.writeReqs/p.writeBuffs to
+// disk starting at (fileIndex, filePos), rolling into a freshly created
+// qfile (possibly more than once) if the active one runs out of room
+// mid-batch. A batch that straddles a rollover must not attribute every
+// request's offset to the file the batch finished in, so each
+// request's landing (fileIndex, pos) is resolved the moment its bytes
+// are confirmed written rather than once at the end, and each file's
+// FileMeta is updated with only the bytes/count it actually received.
+// It returns the (fileIndex, pos) the next batch should continue from.
+func (p *partition) flushBatch(fileIndex int, filePos int64) (int, int64) {
+	ends := p.reqEnds[:len(p.writeReqs)]
+	var cum int64
+	for i := range p.writeReqs {
+		cum += int64(recordHeaderSize + len(p.scratchBuffs[i]))
+		ends[i] = cum
+	}
+
+	qf := p.files[fileIndex]
+	// segStart/segPos mark where the file currently being written to
+	// begins, in batch-relative and on-disk coordinates respectively;
+	// written tracks bytes landed in it so far, resolved/segResolved
+	// how many requests that accounts for (overall and in this file).
+	segStart, segPos := int64(0), filePos
+	var written int64
+	var resolved, segResolved int
+
+	resolve := func(through int64) {
+		for resolved < len(p.writeReqs) && ends[resolved] <= segStart+through {
+			size := int64(recordHeaderSize + len(p.scratchBuffs[resolved]))
+			begin := ends[resolved] - size
+			p.writeReqs[resolved].result <- writeResult{offset: encodeOffset(p.idx, fileIndex, segPos+(begin-segStart))}
+			resolved++
+			segResolved++
+		}
+	}
+
+	util.TryUntilSuccess(func() bool {
+		for {
+			wroteN, err := p.writeBuffs.WriteTo(qf)
+			written += wroteN
+			if err == mapped.ErrWriteBeyond {
+				// 写超了，需要新开文件: flush what this file actually
+				// received before moving on, so its FileMeta and the
+				// requests it holds aren't attributed to the new file.
+				resolve(written)
+				p.meta.UpdateFileStat(fileIndex, segResolved, segPos+written, NowNano())
+
+				if cerr := p.createQfile(); cerr != nil {
+					logger.Instance().Error("handleWrite createQfile", zap.Int("partition", p.idx), zap.Error(cerr))
+					return false
+				}
+				segStart += written
+				fileIndex = len(p.files) - 1
+				qf = p.files[fileIndex]
+				segPos, written, segResolved = 0, 0, 0
+				continue
+			}
+			if err != nil {
+				logger.Instance().Error("handleWrite WriteTo", zap.Int("partition", p.idx), zap.Error(err))
+				return false
+			}
+
+			resolve(written)
+			p.meta.UpdateFileStat(fileIndex, segResolved, segPos+written, NowNano())
+			return true
+		}
+	}, time.Second)
+
+	return fileIndex, segPos + written
+}
+
+// writeSemaphore bounds the number of in-flight fsyncs across all
+// partitions so a burst of writers can't starve the disk.
+type writeSemaphore chan struct{}
+
+func newWriteSemaphore(n int) writeSemaphore {
+	if n <= 0 {
+		return nil
+	}
+	return make(writeSemaphore, n)
+}
+
+func (s writeSemaphore) acquire() {
+	if s == nil {
+		return
+	}
+	s <- struct{}{}
+}
+
+func (s writeSemaphore) release() {
+	if s == nil {
+		return
+	}
+	<-s
+}
+
+// fnvPartition hashes key to a partition index via fnv-1a, matching
+// the hashing scheme already used elsewhere in this module family.
+func fnvPartition(key []byte, n int) int {
+	h := fnv.New32a()
+	h.Write(key)
+	return int(h.Sum32()) % n
+}
+
+const (
+	partitionShift = 48
+	fileIndexShift = 32
+	posMask        = 1<<fileIndexShift - 1
+)
+
+// encodeOffset packs (partition, fileIndex, pos) into the int64
+// handed back from Put, so Read can locate the owning shard directly.
+func encodeOffset(partition, fileIndex int, pos int64) int64 {
+	return int64(partition)<<partitionShift | int64(fileIndex)<<fileIndexShift | pos
+}
+
+func decodeOffset(offset int64) (partition, fileIndex int, pos int64) {
+	partition = int(offset >> partitionShift)
+	fileIndex = int((offset >> fileIndexShift) & (1<<16 - 1))
+	pos = offset & posMask
+	return
+}
@@ -0,0 +1,127 @@
+package diskqueue
+
+import (
+	"testing"
+	"time"
+)
+
+// TestReadCursorSurvivesRestartPerPartition is a regression test for the
+// bug where Init only ever seeded partition 0's lane from its persisted
+// queueMeta cursor, so every other partition replayed its entire
+// on-disk history on every restart. Acking offset X persists X itself
+// as the partition's resume point, so each partition's last acked
+// message is legitimately redelivered once after the restart; anything
+// beyond that indicates a partition resumed from scratch.
+func TestReadCursorSurvivesRestartPerPartition(t *testing.T) {
+	conf := Conf{Directory: t.TempDir(), Partitions: 4}
+
+	q := New(conf)
+	if err := q.Init(); err != nil {
+		t.Fatalf("Init: %v", err)
+	}
+
+	const n = 40
+	for i := 0; i < n; i++ {
+		if _, err := q.Put([]byte("msg")); err != nil {
+			t.Fatalf("Put: %v", err)
+		}
+	}
+
+	acked := 0
+	timeout := time.After(2 * time.Second)
+	for acked < n {
+		select {
+		case msg := <-q.ReadChan():
+			if err := q.Ack(msg.Offset); err != nil {
+				t.Fatalf("Ack: %v", err)
+			}
+			acked++
+		case <-timeout:
+			t.Fatalf("only acked %d/%d messages before timeout", acked, n)
+		}
+	}
+
+	if err := q.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	q2 := New(conf)
+	if err := q2.Init(); err != nil {
+		t.Fatalf("re-Init: %v", err)
+	}
+	defer q2.Close()
+
+	redelivered := 0
+drain:
+	for {
+		select {
+		case <-q2.ReadChan():
+			redelivered++
+			if redelivered > conf.Partitions {
+				t.Fatalf("got %d redelivered messages after restart, want at most %d (one in-flight message per partition)", redelivered, conf.Partitions)
+			}
+		case <-time.After(300 * time.Millisecond):
+			break drain
+		}
+	}
+}
+
+// TestMinRetainedFileIndexIgnoresUnusedReaderCursor is a regression test
+// for the bug where minRetainedFileIndex always folded in the built-in
+// ReadChan/Ack cursor even when an application only ever consumed via
+// Subscribe, so that cursor's zero-valued initial position permanently
+// floored retention regardless of how far every consumer group had
+// acked.
+func TestMinRetainedFileIndexIgnoresUnusedReaderCursor(t *testing.T) {
+	conf := Conf{Directory: t.TempDir(), Partitions: 1}
+	q := New(conf)
+	if err := q.Init(); err != nil {
+		t.Fatalf("Init: %v", err)
+	}
+	defer q.Close()
+
+	c, err := q.Subscribe("only-group")
+	if err != nil {
+		t.Fatalf("Subscribe: %v", err)
+	}
+
+	// The only consumer has acked well past file 0; the default
+	// reader's cursor is never touched by this application.
+	c.lanes[0].mu.Lock()
+	c.lanes[0].ackFileIndex = 3
+	c.lanes[0].mu.Unlock()
+
+	if got := q.minRetainedFileIndex(0); got != 3 {
+		t.Fatalf("minRetainedFileIndex = %d, want 3 (unused built-in reader must not floor retention)", got)
+	}
+}
+
+// TestMinRetainedFileIndexHonorsUsedReaderCursor confirms that once an
+// application does Ack the built-in reader, its cursor still correctly
+// participates in the floor computation alongside consumer groups.
+func TestMinRetainedFileIndexHonorsUsedReaderCursor(t *testing.T) {
+	conf := Conf{Directory: t.TempDir(), Partitions: 1}
+	q := New(conf)
+	if err := q.Init(); err != nil {
+		t.Fatalf("Init: %v", err)
+	}
+	defer q.Close()
+
+	c, err := q.Subscribe("ahead-group")
+	if err != nil {
+		t.Fatalf("Subscribe: %v", err)
+	}
+	c.lanes[0].mu.Lock()
+	c.lanes[0].ackFileIndex = 5
+	c.lanes[0].mu.Unlock()
+
+	lane := q.readers()[0]
+	lane.reader.mu.Lock()
+	lane.reader.used = true
+	lane.reader.ackFileIndex = 1
+	lane.reader.mu.Unlock()
+
+	if got := q.minRetainedFileIndex(0); got != 1 {
+		t.Fatalf("minRetainedFileIndex = %d, want 1 (the slower of the two cursors)", got)
+	}
+}
@@ -0,0 +1,348 @@
+package diskqueue
+
+import (
+	"bufio"
+	"errors"
+	"hash/crc32"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/zhiqiangxu/util"
+	"github.com/zhiqiangxu/util/logger"
+	"go.uber.org/zap"
+)
+
+// reader tails a single partition's qfiles sequentially, tracking an
+// ack-based commit cursor that's periodically flushed to that
+// partition's queueMeta. Queue runs one reader per partition and fans
+// the results into the shared readCh.
+type reader struct {
+	mu sync.Mutex
+
+	fileIndex int
+	pos       int64
+
+	ackFileIndex int
+	ackPos       int64
+	dirty        bool
+
+	// used marks that Ack has actually been called against this lane.
+	// An application that only consumes via Subscribe never touches
+	// ReadChan/Ack, so this cursor would otherwise sit at its initial
+	// persisted value forever and wrongly floor retention for every
+	// consumer group.
+	used bool
+}
+
+var errNoData = errors.New("diskqueue: no more data")
+
+// Message pairs a record's payload with the offset Ack needs to commit
+// past it.
+type Message struct {
+	Offset int64
+	Data   []byte
+}
+
+// ReadChan returns a channel of messages merged across all partitions,
+// in no particular cross-partition order. Messages are not removed
+// from disk until Ack is called with their offset.
+func (q *Queue) ReadChan() <-chan Message {
+	return q.readCh
+}
+
+// ErrChan surfaces unrecoverable per-partition read errors: with
+// StrictChecksum set, a corrupt record halts that partition's tailLane
+// goroutine (instead of retrying it forever) and its error is reported
+// here so callers notice the stream stalled rather than just seeing
+// ReadChan go quiet.
+func (q *Queue) ErrChan() <-chan error {
+	return q.errCh
+}
+
+// Ack commits the read cursor for offset's partition up to offset,
+// allowing qfiles entirely below it to become eligible for retention.
+// The commit itself is only persisted on the handleCommit cadence.
+func (q *Queue) Ack(offset int64) error {
+	partIdx, fileIndex, pos := decodeOffset(offset)
+	if partIdx < 0 || partIdx >= len(q.partitions) {
+		return errBadOffset
+	}
+
+	r := &q.readers()[partIdx].reader
+	r.mu.Lock()
+	r.used = true
+	if fileIndex > r.ackFileIndex || (fileIndex == r.ackFileIndex && pos > r.ackPos) {
+		r.ackFileIndex = fileIndex
+		r.ackPos = pos
+		r.dirty = true
+	}
+	r.mu.Unlock()
+
+	select {
+	case q.ackNotifyCh <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Peek returns the next unread message from the first partition that
+// has one, without advancing past it.
+func (q *Queue) Peek() (data []byte, err error) {
+	for _, lane := range q.readers() {
+		lane.reader.mu.Lock()
+		data, _, err = lane.p.readRecordLocked(lane.reader.fileIndex, lane.reader.pos)
+		lane.reader.mu.Unlock()
+		if err == nil {
+			return
+		}
+	}
+	return nil, errNoData
+}
+
+// Depth reports how many bytes the read cursor trails the writer by,
+// summed across every partition.
+func (q *Queue) Depth() int64 {
+	var depth int64
+	for _, lane := range q.readers() {
+		lane.reader.mu.Lock()
+		fileIndex, pos := lane.reader.fileIndex, lane.reader.pos
+		lane.reader.mu.Unlock()
+
+		nFiles := lane.p.meta.NumFiles()
+		for i := fileIndex; i < nFiles; i++ {
+			fm := lane.p.meta.FileMeta(i)
+			if i == fileIndex {
+				depth += fm.EndOffset - pos
+			} else {
+				depth += fm.EndOffset
+			}
+		}
+	}
+	return depth
+}
+
+// readerLane pairs a partition with the reader tailing it.
+type readerLane struct {
+	p      *partition
+	reader reader
+}
+
+// readers lazily builds one lane per partition the first time it's
+// needed, seeding each lane's cursor from that partition's own
+// persisted queueMeta so a restart resumes every partition from where
+// it last committed rather than only partition 0.
+func (q *Queue) readers() []*readerLane {
+	q.lanesOnce.Do(func() {
+		q.lanes = make([]*readerLane, len(q.partitions))
+		for i, p := range q.partitions {
+			lane := &readerLane{p: p}
+			fileIndex, pos := p.meta.ReadCursor()
+			lane.reader.fileIndex, lane.reader.pos = fileIndex, pos
+			lane.reader.ackFileIndex, lane.reader.ackPos = fileIndex, pos
+			q.lanes[i] = lane
+		}
+	})
+	return q.lanes
+}
+
+// handleRead streams records from every partition into readCh, one
+// goroutine per partition so a slow partition doesn't stall the rest.
+func (q *Queue) handleRead() {
+	lanes := q.readers()
+	var wg sync.WaitGroup
+	for _, lane := range lanes {
+		lane := lane
+		wg.Add(1)
+		util.GoFunc(&wg, func() { q.tailLane(lane) })
+	}
+	wg.Wait()
+}
+
+func (q *Queue) tailLane(lane *readerLane) {
+	for {
+		data, offset, err := q.nextRecord(lane)
+		if err != nil {
+			if err == errChecksumMismatch {
+				logger.Instance().Error("tailLane halted on checksum mismatch", zap.Int("partition", lane.p.idx), zap.Error(err))
+				select {
+				case q.errCh <- err:
+				default:
+				}
+				return
+			}
+			select {
+			case <-time.After(time.Millisecond * 100):
+			case <-q.doneCh:
+				return
+			}
+			continue
+		}
+
+		select {
+		case q.readCh <- Message{Offset: offset, Data: data}:
+		case <-q.doneCh:
+			return
+		}
+	}
+}
+
+func (q *Queue) nextRecord(lane *readerLane) (data []byte, offset int64, err error) {
+	lane.reader.mu.Lock()
+	defer lane.reader.mu.Unlock()
+
+	var size int
+	data, size, err = lane.p.readRecordLocked(lane.reader.fileIndex, lane.reader.pos)
+	if err != nil {
+		return
+	}
+
+	offset = encodeOffset(lane.p.idx, lane.reader.fileIndex, lane.reader.pos)
+	lane.reader.pos += int64(size)
+	lane.rolloverLocked()
+	return
+}
+
+// readRecordLocked reads the next framed record at or after
+// (fileIndex, pos), preferring the qfile's mapped region for a
+// zero-copy slice and falling back to a bufio.Reader when the mapping
+// isn't available. It returns the payload and the total on-disk size
+// consumed starting at pos (which may span skipped corrupt records
+// when StrictChecksum is off).
+func (p *partition) readRecordLocked(fileIndex int, pos int64) (data []byte, consumed int, err error) {
+	p.filesMu.RLock()
+	defer p.filesMu.RUnlock()
+
+	for {
+		var size int
+		data, size, err = p.readOneRecordLocked(fileIndex, pos)
+		if err == nil {
+			consumed += size
+			return
+		}
+		if err != errChecksumMismatch || p.conf.StrictChecksum {
+			return
+		}
+
+		logger.Instance().Error("readRecordLocked checksum mismatch, skipping", zap.Int("partition", p.idx), zap.Int("file", fileIndex), zap.Int64("pos", pos))
+		consumed += size
+		pos += int64(size)
+	}
+}
+
+func (p *partition) readOneRecordLocked(fileIndex int, pos int64) (data []byte, consumed int, err error) {
+	if fileIndex >= len(p.files) {
+		err = errNoData
+		return
+	}
+
+	fm := p.meta.FileMeta(fileIndex)
+	if pos >= fm.EndOffset {
+		err = errNoData
+		return
+	}
+
+	qf := p.files[fileIndex]
+
+	var size int
+	var crc uint32
+	var codecID uint8
+	var encoded []byte
+	if region, ok := qf.Mapped(); ok {
+		if pos+recordHeaderSize > int64(len(region)) {
+			err = errNoData
+			return
+		}
+		size, crc, _, codecID = parseRecordHeader(region[pos : pos+recordHeaderSize])
+		start := pos + recordHeaderSize
+		end := start + int64(size)
+		if end > int64(len(region)) {
+			err = errNoData
+			return
+		}
+		encoded = region[start:end]
+	} else {
+		br := bufio.NewReaderSize(io.NewSectionReader(qf, pos, fm.EndOffset-pos), 64*1024)
+		header := make([]byte, recordHeaderSize)
+		if _, err = io.ReadFull(br, header); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				err = errNoData
+			}
+			return
+		}
+		size, crc, _, codecID = parseRecordHeader(header)
+		encoded = make([]byte, size)
+		if _, err = io.ReadFull(br, encoded); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				err = errNoData
+			}
+			return
+		}
+	}
+	consumed = recordHeaderSize + size
+
+	if crc32.Checksum(encoded, castagnoli) != crc {
+		return nil, consumed, errChecksumMismatch
+	}
+
+	codec, err := p.codecs.get(codecID)
+	if err != nil {
+		return nil, consumed, err
+	}
+	data, err = codec.Decode(nil, encoded)
+	return
+}
+
+func (lane *readerLane) rolloverLocked() {
+	fm := lane.p.meta.FileMeta(lane.reader.fileIndex)
+	if lane.reader.pos >= fm.EndOffset && lane.reader.fileIndex < len(lane.p.files)-1 {
+		lane.reader.fileIndex++
+		lane.reader.pos = 0
+	}
+}
+
+// handleCommit persists every partition's acked read cursor, plus
+// every consumer group's, on the configured SyncEvery/SyncTimeout
+// cadence.
+func (q *Queue) handleCommit() {
+	ticker := time.NewTicker(q.conf.SyncTimeout)
+	defer ticker.Stop()
+
+	var acksSinceSync int
+	for {
+		select {
+		case <-ticker.C:
+			q.syncReadCursors()
+			q.syncGroupCursors()
+			acksSinceSync = 0
+		case <-q.ackNotifyCh:
+			acksSinceSync++
+			if acksSinceSync >= q.conf.SyncEvery {
+				q.syncReadCursors()
+				q.syncGroupCursors()
+				acksSinceSync = 0
+			}
+		case <-q.doneCh:
+			q.syncReadCursors()
+			q.syncGroupCursors()
+			return
+		}
+	}
+}
+
+func (q *Queue) syncReadCursors() {
+	for _, lane := range q.readers() {
+		lane.reader.mu.Lock()
+		if !lane.reader.dirty {
+			lane.reader.mu.Unlock()
+			continue
+		}
+		fileIndex, pos := lane.reader.ackFileIndex, lane.reader.ackPos
+		lane.reader.dirty = false
+		lane.reader.mu.Unlock()
+
+		if err := lane.p.meta.UpdateReadCursor(fileIndex, pos); err != nil {
+			logger.Instance().Error("syncReadCursors UpdateReadCursor", zap.Int("partition", lane.p.idx), zap.Error(err))
+		}
+	}
+}
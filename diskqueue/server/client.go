@@ -0,0 +1,157 @@
+package server
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/zhiqiangxu/util/diskqueue"
+	"github.com/zhiqiangxu/util/logger"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultClientChSize = 128
+	defaultRetryEvery   = time.Second
+)
+
+// Client tails a remote Queue exposed by a Server, reconnecting
+// automatically on a dropped connection. Each reconnect subscribes
+// with the highest offset acked so far as its start offset, which the
+// server applies as SubscribeFrom does: only in the partition that
+// offset names, and only while the group's persisted cursor there is
+// still at the start of the log; otherwise the group resumes from its
+// server-persisted cursor. Both resume points are acked offsets, so
+// the message at a partition's last acked offset is delivered again
+// after a reconnect.
+type Client struct {
+	addr  string
+	group string
+
+	retryEvery time.Duration
+
+	mu      sync.Mutex
+	conn    net.Conn
+	lastAck int64
+	closed  bool
+
+	readCh chan diskqueue.Message
+	doneCh chan struct{}
+	wg     sync.WaitGroup
+}
+
+// NewClient dials addr and starts tailing groupName's stream, starting
+// from startOffset the first time groupName is ever subscribed on the
+// server. It connects in the background; ReadChan starts delivering
+// once the connection succeeds.
+func NewClient(addr, groupName string, startOffset int64) *Client {
+	c := &Client{
+		addr:       addr,
+		group:      groupName,
+		retryEvery: defaultRetryEvery,
+		lastAck:    startOffset,
+		readCh:     make(chan diskqueue.Message, defaultClientChSize),
+		doneCh:     make(chan struct{}),
+	}
+
+	c.wg.Add(1)
+	go c.run()
+	return c
+}
+
+// ReadChan returns the client's stream of messages.
+func (c *Client) ReadChan() <-chan diskqueue.Message {
+	return c.readCh
+}
+
+// Ack records offset as read, the point a reconnect resumes from, and
+// forwards it to the server so the remote group cursor commits.
+func (c *Client) Ack(offset int64) error {
+	c.mu.Lock()
+	if offset > c.lastAck {
+		c.lastAck = offset
+	}
+	conn := c.conn
+	c.mu.Unlock()
+
+	if conn == nil {
+		return nil
+	}
+	return writeAck(conn, offset)
+}
+
+// Close stops the client's reconnect loop and waits for it to exit.
+func (c *Client) Close() error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil
+	}
+	c.closed = true
+	conn := c.conn
+	c.mu.Unlock()
+
+	close(c.doneCh)
+	if conn != nil {
+		conn.Close()
+	}
+	c.wg.Wait()
+	return nil
+}
+
+func (c *Client) run() {
+	defer c.wg.Done()
+
+	for {
+		select {
+		case <-c.doneCh:
+			return
+		default:
+		}
+
+		if err := c.serveOnce(); err != nil {
+			logger.Instance().Error("client serveOnce", zap.String("addr", c.addr), zap.String("group", c.group), zap.Error(err))
+		}
+
+		select {
+		case <-c.doneCh:
+			return
+		case <-time.After(c.retryEvery):
+		}
+	}
+}
+
+func (c *Client) serveOnce() error {
+	conn, err := net.Dial("tcp", c.addr)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	resumeFrom := c.lastAck
+	c.conn = conn
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		c.conn = nil
+		c.mu.Unlock()
+		conn.Close()
+	}()
+
+	if err := writeSubscribe(conn, c.group, resumeFrom); err != nil {
+		return err
+	}
+
+	for {
+		msg, err := readFrame(conn)
+		if err != nil {
+			return err
+		}
+
+		select {
+		case c.readCh <- msg:
+		case <-c.doneCh:
+			return nil
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package server
+
+import (
+	"net"
+	"sync"
+
+	"github.com/zhiqiangxu/util/diskqueue"
+	"github.com/zhiqiangxu/util/logger"
+	"go.uber.org/zap"
+)
+
+// Server exposes a diskqueue.Queue to remote consumers over a simple
+// length-prefixed TCP protocol, analogous to nsqd's TCP protocol: a
+// client connects, sends a Subscribe request naming its consumer group
+// and a resume offset, then receives a stream of framed messages and
+// periodically sends back ACK frames to advance its committed cursor.
+// Subscribing reuses the same consumer-group machinery Queue.Subscribe
+// uses locally, so a remote group's cursor persists and is reap-aware
+// exactly like a local one.
+type Server struct {
+	q    *diskqueue.Queue
+	addr string
+
+	mu sync.Mutex
+	ln net.Listener
+
+	wg        sync.WaitGroup
+	closeOnce sync.Once
+	doneCh    chan struct{}
+}
+
+// New wraps q for network access on addr ("host:port"). Closing q also
+// closes the Server first, draining any in-flight streams.
+func New(q *diskqueue.Queue, addr string) *Server {
+	s := &Server{q: q, addr: addr, doneCh: make(chan struct{})}
+	q.OnClose(func() { s.Close() })
+	return s
+}
+
+// Addr returns the address the server is actually listening on, or
+// nil if ListenAndServe hasn't started accepting connections yet.
+// Tests that bind an ephemeral port ("127.0.0.1:0") use this to learn
+// which port the server picked.
+func (s *Server) Addr() net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ln == nil {
+		return nil
+	}
+	return s.ln.Addr()
+}
+
+// ListenAndServe opens addr and blocks accepting connections until
+// Close is called.
+func (s *Server) ListenAndServe() error {
+	ln, err := net.Listen("tcp", s.addr)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.ln = ln
+	s.mu.Unlock()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			select {
+			case <-s.doneCh:
+				return nil
+			default:
+				return err
+			}
+		}
+
+		s.wg.Add(1)
+		go s.handleConn(conn)
+	}
+}
+
+// Close stops accepting new connections and blocks until every
+// in-flight stream has flushed and its connection has closed.
+func (s *Server) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.doneCh)
+		s.mu.Lock()
+		ln := s.ln
+		s.mu.Unlock()
+		if ln != nil {
+			ln.Close()
+		}
+	})
+	s.wg.Wait()
+	return nil
+}
+
+func (s *Server) handleConn(conn net.Conn) {
+	defer s.wg.Done()
+
+	var closeConnOnce sync.Once
+	closeConn := func() { closeConnOnce.Do(func() { conn.Close() }) }
+	defer closeConn()
+
+	groupName, startOffset, err := readSubscribe(conn)
+	if err != nil {
+		logger.Instance().Error("server readSubscribe", zap.Error(err))
+		return
+	}
+
+	c, err := s.q.SubscribeFrom(groupName, startOffset)
+	if err != nil {
+		logger.Instance().Error("server SubscribeFrom", zap.String("group", groupName), zap.Error(err))
+		return
+	}
+
+	var ackWG sync.WaitGroup
+	ackWG.Add(1)
+	go func() {
+		defer ackWG.Done()
+		for {
+			offset, err := readAck(conn)
+			if err != nil {
+				return
+			}
+			if err := c.Ack(offset); err != nil {
+				logger.Instance().Error("server Ack", zap.String("group", groupName), zap.Error(err))
+			}
+		}
+	}()
+
+	for {
+		select {
+		case msg, ok := <-c.ReadChan():
+			if !ok {
+				closeConn()
+				ackWG.Wait()
+				return
+			}
+			if err := writeFrame(conn, msg); err != nil {
+				closeConn()
+				ackWG.Wait()
+				return
+			}
+		case <-s.doneCh:
+			closeConn()
+			ackWG.Wait()
+			return
+		}
+	}
+}
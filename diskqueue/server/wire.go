@@ -0,0 +1,98 @@
+package server
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"github.com/zhiqiangxu/util/diskqueue"
+)
+
+// Wire format, all big-endian:
+//
+//	Subscribe (client -> server, once, at connection start):
+//	  groupNameLen uint32 | groupName []byte | startOffset int64
+//
+//	Data frame (server -> client, one per message):
+//	  offset int64 | payloadLen uint32 | payload []byte
+//
+//	Ack (client -> server, periodically):
+//	  tag byte(0x41) | offset int64
+
+const ackTag = 0x41
+
+var errBadAckFrame = errors.New("diskqueue/server: malformed ack frame")
+
+func writeSubscribe(w io.Writer, groupName string, startOffset int64) error {
+	buf := make([]byte, 4+len(groupName)+8)
+	binary.BigEndian.PutUint32(buf[:4], uint32(len(groupName)))
+	copy(buf[4:], groupName)
+	binary.BigEndian.PutUint64(buf[4+len(groupName):], uint64(startOffset))
+	_, err := w.Write(buf)
+	return err
+}
+
+func readSubscribe(r io.Reader) (groupName string, startOffset int64, err error) {
+	var lenBuf [4]byte
+	if _, err = io.ReadFull(r, lenBuf[:]); err != nil {
+		return
+	}
+
+	nameBuf := make([]byte, binary.BigEndian.Uint32(lenBuf[:]))
+	if _, err = io.ReadFull(r, nameBuf); err != nil {
+		return
+	}
+
+	var offBuf [8]byte
+	if _, err = io.ReadFull(r, offBuf[:]); err != nil {
+		return
+	}
+
+	groupName = string(nameBuf)
+	startOffset = int64(binary.BigEndian.Uint64(offBuf[:]))
+	return
+}
+
+func writeFrame(w io.Writer, msg diskqueue.Message) error {
+	header := make([]byte, 12)
+	binary.BigEndian.PutUint64(header[:8], uint64(msg.Offset))
+	binary.BigEndian.PutUint32(header[8:], uint32(len(msg.Data)))
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	_, err := w.Write(msg.Data)
+	return err
+}
+
+func readFrame(r io.Reader) (msg diskqueue.Message, err error) {
+	header := make([]byte, 12)
+	if _, err = io.ReadFull(r, header); err != nil {
+		return
+	}
+
+	msg.Offset = int64(binary.BigEndian.Uint64(header[:8]))
+	msg.Data = make([]byte, binary.BigEndian.Uint32(header[8:]))
+	_, err = io.ReadFull(r, msg.Data)
+	return
+}
+
+func writeAck(w io.Writer, offset int64) error {
+	buf := make([]byte, 9)
+	buf[0] = ackTag
+	binary.BigEndian.PutUint64(buf[1:], uint64(offset))
+	_, err := w.Write(buf)
+	return err
+}
+
+func readAck(r io.Reader) (offset int64, err error) {
+	buf := make([]byte, 9)
+	if _, err = io.ReadFull(r, buf); err != nil {
+		return
+	}
+	if buf[0] != ackTag {
+		err = errBadAckFrame
+		return
+	}
+	offset = int64(binary.BigEndian.Uint64(buf[1:]))
+	return
+}
@@ -0,0 +1,64 @@
+package server
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/zhiqiangxu/util/diskqueue"
+)
+
+func TestSubscribeFrameRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	if err := writeSubscribe(&buf, "my-group", 12345); err != nil {
+		t.Fatalf("writeSubscribe: %v", err)
+	}
+
+	groupName, startOffset, err := readSubscribe(&buf)
+	if err != nil {
+		t.Fatalf("readSubscribe: %v", err)
+	}
+	if groupName != "my-group" || startOffset != 12345 {
+		t.Fatalf("readSubscribe = (%q, %d), want (%q, %d)", groupName, startOffset, "my-group", 12345)
+	}
+}
+
+func TestDataFrameRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	msg := diskqueue.Message{Offset: 98765, Data: []byte("payload bytes")}
+	if err := writeFrame(&buf, msg); err != nil {
+		t.Fatalf("writeFrame: %v", err)
+	}
+
+	got, err := readFrame(&buf)
+	if err != nil {
+		t.Fatalf("readFrame: %v", err)
+	}
+	if got.Offset != msg.Offset || !bytes.Equal(got.Data, msg.Data) {
+		t.Fatalf("readFrame = %+v, want %+v", got, msg)
+	}
+}
+
+func TestAckFrameRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	if err := writeAck(&buf, 424242); err != nil {
+		t.Fatalf("writeAck: %v", err)
+	}
+
+	offset, err := readAck(&buf)
+	if err != nil {
+		t.Fatalf("readAck: %v", err)
+	}
+	if offset != 424242 {
+		t.Fatalf("readAck = %d, want 424242", offset)
+	}
+}
+
+func TestReadAckRejectsBadTag(t *testing.T) {
+	var buf bytes.Buffer
+	buf.WriteByte(0xFF)
+	buf.Write(make([]byte, 8))
+
+	if _, err := readAck(&buf); err != errBadAckFrame {
+		t.Fatalf("readAck err = %v, want errBadAckFrame", err)
+	}
+}